@@ -0,0 +1,243 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ewmaTau controls how quickly the p2c-ewma balancer's latency estimate
+// reacts to new samples; smaller values weigh recent samples more heavily.
+const ewmaTau = 10 * time.Second
+
+// balancer selects an instance among a set of candidates returned by the
+// resolver, and optionally tracks feedback from the requests it routed.
+type balancer interface {
+	// pick selects one of the given instances. instances is never empty.
+	pick(instances []consulInstance) consulInstance
+
+	// reportStart and reportDone bracket an in-flight request to addr.
+	reportStart(addr string)
+	reportDone(addr string)
+
+	// reportLatency records an observed round-trip latency for addr.
+	reportLatency(addr string, dur time.Duration)
+
+	// scores returns a snapshot of the balancer's per-backend state, for
+	// exposition on the health/metrics endpoint.
+	scores() map[string]float64
+
+	// estimate returns the balancer's current latency estimate for addr,
+	// used as the P95 proxy that triggers hedged requests. Balancers with
+	// no latency tracking return 0, which disables hedging.
+	estimate(addr string) time.Duration
+}
+
+// newBalancer constructs a balancer for the named strategy. Unrecognized
+// names fall back to "random", matching the router's historical behavior.
+func newBalancer(name string) balancer {
+	switch name {
+	case "weighted-round-robin":
+		return newWeightedRoundRobinBalancer()
+	case "p2c-ewma":
+		return newP2CEWMABalancer()
+	default:
+		return randomBalancer{}
+	}
+}
+
+func instanceAddr(i consulInstance) string {
+	return i.Address + ":" + strconv.Itoa(i.Port)
+}
+
+// randomBalancer is the router's original strategy: pick uniformly at
+// random among the candidates.
+type randomBalancer struct{}
+
+func (randomBalancer) pick(instances []consulInstance) consulInstance {
+	return instances[rand.Intn(len(instances))]
+}
+
+func (randomBalancer) reportStart(string)                  {}
+func (randomBalancer) reportDone(string)                   {}
+func (randomBalancer) reportLatency(string, time.Duration) {}
+func (randomBalancer) scores() map[string]float64          { return nil }
+func (randomBalancer) estimate(string) time.Duration       { return 0 }
+
+// weightedRoundRobinBalancer implements smooth weighted round-robin over
+// consul's ServiceWeights.Passing, the same algorithm nginx uses for its
+// weighted upstream groups.
+type weightedRoundRobinBalancer struct {
+	mutex   sync.Mutex
+	entries map[string]*wrrEntry
+}
+
+type wrrEntry struct {
+	weight  int
+	current int
+}
+
+func newWeightedRoundRobinBalancer() *weightedRoundRobinBalancer {
+	return &weightedRoundRobinBalancer{entries: make(map[string]*wrrEntry)}
+}
+
+func (b *weightedRoundRobinBalancer) pick(instances []consulInstance) consulInstance {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	total := 0
+	var best *wrrEntry
+	var bestInstance consulInstance
+
+	for _, instance := range instances {
+		addr := instanceAddr(instance)
+		weight := instance.Weights.Passing
+		if weight <= 0 {
+			weight = 1
+		}
+
+		entry, ok := b.entries[addr]
+		if !ok {
+			entry = &wrrEntry{}
+			b.entries[addr] = entry
+		}
+		entry.weight = weight
+		entry.current += weight
+		total += weight
+
+		if best == nil || entry.current > best.current {
+			best = entry
+			bestInstance = instance
+		}
+	}
+
+	best.current -= total
+	return bestInstance
+}
+
+func (b *weightedRoundRobinBalancer) reportStart(string)                  {}
+func (b *weightedRoundRobinBalancer) reportDone(string)                   {}
+func (b *weightedRoundRobinBalancer) reportLatency(string, time.Duration) {}
+func (b *weightedRoundRobinBalancer) estimate(string) time.Duration       { return 0 }
+
+func (b *weightedRoundRobinBalancer) scores() map[string]float64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	scores := make(map[string]float64, len(b.entries))
+	for addr, entry := range b.entries {
+		scores[addr] = float64(entry.weight)
+	}
+	return scores
+}
+
+// p2cBackend tracks the state p2c-ewma needs for a single backend.
+type p2cBackend struct {
+	ewmaLatency float64
+	inflight    int64
+	lastUpdate  time.Time
+}
+
+// p2cEWMABalancer implements power-of-two-choices with an exponentially
+// weighted moving average of observed latency: on each pick it samples two
+// random backends and routes to whichever has the lower score of
+// ewmaLatency*(inflight+1).
+type p2cEWMABalancer struct {
+	mutex    sync.Mutex
+	backends map[string]*p2cBackend
+}
+
+func newP2CEWMABalancer() *p2cEWMABalancer {
+	return &p2cEWMABalancer{backends: make(map[string]*p2cBackend)}
+}
+
+func (b *p2cEWMABalancer) backend(addr string) *p2cBackend {
+	backend, ok := b.backends[addr]
+	if !ok {
+		backend = &p2cBackend{lastUpdate: time.Now()}
+		b.backends[addr] = backend
+	}
+	return backend
+}
+
+func (b *p2cEWMABalancer) score(addr string) float64 {
+	backend := b.backend(addr)
+	return backend.ewmaLatency * float64(backend.inflight+1)
+}
+
+func (b *p2cEWMABalancer) pick(instances []consulInstance) consulInstance {
+	if len(instances) == 1 {
+		return instances[0]
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	i, j := rand.Intn(len(instances)), rand.Intn(len(instances)-1)
+	if j >= i {
+		j++
+	}
+
+	a, c := instances[i], instances[j]
+	if b.score(instanceAddr(a)) <= b.score(instanceAddr(c)) {
+		return a
+	}
+	return c
+}
+
+func (b *p2cEWMABalancer) reportStart(addr string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.backend(addr).inflight++
+}
+
+func (b *p2cEWMABalancer) reportDone(addr string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.backend(addr).inflight--
+}
+
+func (b *p2cEWMABalancer) reportLatency(addr string, dur time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	backend := b.backend(addr)
+	now := time.Now()
+	sample := float64(dur)
+
+	if backend.ewmaLatency == 0 {
+		backend.ewmaLatency = sample
+	} else {
+		dt := now.Sub(backend.lastUpdate)
+		alpha := math.Exp(-float64(dt) / float64(ewmaTau))
+		backend.ewmaLatency = backend.ewmaLatency*alpha + sample*(1-alpha)
+	}
+	backend.lastUpdate = now
+}
+
+// estimate returns the backend's current ewma latency, used by the server
+// as a stand-in for that backend's P95 latency when deciding whether to
+// fire a hedged request.
+func (b *p2cEWMABalancer) estimate(addr string) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	backend, ok := b.backends[addr]
+	if !ok {
+		return 0
+	}
+	return time.Duration(backend.ewmaLatency)
+}
+
+func (b *p2cEWMABalancer) scores() map[string]float64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	scores := make(map[string]float64, len(b.backends))
+	for addr, backend := range b.backends {
+		scores[addr] = backend.ewmaLatency * float64(backend.inflight+1)
+	}
+	return scores
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// addrFor returns the instanceAddr for a bare name, the same way the
+// balancers key their internal per-backend state.
+func addrFor(name string) string {
+	return instanceAddr(consulInstance{Address: name})
+}
+
+func instances(weights map[string]int) []consulInstance {
+	var out []consulInstance
+	for _, addr := range []string{"a", "b", "c"} {
+		weight, ok := weights[addr]
+		if !ok {
+			continue
+		}
+		instance := consulInstance{Address: addr, Port: 0}
+		instance.Weights.Passing = weight
+		out = append(out, instance)
+	}
+	return out
+}
+
+func TestWeightedRoundRobinBalancer(t *testing.T) {
+	// The classic nginx smooth weighted round-robin example: weights 5/1/1
+	// over one full cycle (sum of weights) should favor "a" without ever
+	// starving "b" or "c" for more than a few picks in a row.
+	candidates := instances(map[string]int{"a": 5, "b": 1, "c": 1})
+
+	bal := newWeightedRoundRobinBalancer()
+	want := []string{"a", "a", "b", "a", "c", "a", "a"}
+	for i, name := range want {
+		got := instanceAddr(bal.pick(candidates))
+		if got != addrFor(name) {
+			t.Errorf("pick %d = %q, want %q", i, got, addrFor(name))
+		}
+	}
+}
+
+func TestWeightedRoundRobinBalancerDefaultsToWeightOne(t *testing.T) {
+	candidates := instances(map[string]int{"a": 0, "b": 0})
+
+	bal := newWeightedRoundRobinBalancer()
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		seen[instanceAddr(bal.pick(candidates))]++
+	}
+	if seen[addrFor("a")] != 2 || seen[addrFor("b")] != 2 {
+		t.Errorf("picks = %v, want an even split for equal (defaulted) weights", seen)
+	}
+}
+
+func TestP2CEWMABalancerPrefersLowerLatencyBackend(t *testing.T) {
+	candidates := instances(map[string]int{"a": 1, "b": 1})
+
+	bal := newP2CEWMABalancer()
+	bal.reportLatency(addrFor("a"), 10*time.Millisecond)
+	bal.reportLatency(addrFor("b"), 100*time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		if got := instanceAddr(bal.pick(candidates)); got != addrFor("a") {
+			t.Fatalf("pick %d = %q, want %q (lower ewma latency)", i, got, addrFor("a"))
+		}
+	}
+}
+
+func TestP2CEWMABalancerInflightBreaksTies(t *testing.T) {
+	candidates := instances(map[string]int{"a": 1, "b": 1})
+
+	bal := newP2CEWMABalancer()
+	bal.reportLatency(addrFor("a"), 10*time.Millisecond)
+	bal.reportLatency(addrFor("b"), 10*time.Millisecond)
+
+	// With equal latency, more in-flight requests on "a" should make "b"
+	// the cheaper (lower score) choice.
+	bal.reportStart(addrFor("a"))
+	bal.reportStart(addrFor("a"))
+
+	if got := instanceAddr(bal.pick(candidates)); got != addrFor("b") {
+		t.Errorf("pick = %q, want %q (fewer in-flight requests)", got, addrFor("b"))
+	}
+}
+
+func TestP2CEWMABalancerEstimateUnknownBackend(t *testing.T) {
+	bal := newP2CEWMABalancer()
+	if got := bal.estimate("unknown"); got != 0 {
+		t.Errorf("estimate for unknown backend = %v, want 0", got)
+	}
+}
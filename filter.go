@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/apex/log"
+)
+
+// filterHeader is the per-request header that lets a caller tighten the
+// router's default -filter expression for a single request, e.g. pin a
+// request to a specific region or version without needing a dedicated
+// preferred tag for every dimension.
+const filterHeader = "X-Consul-Filter"
+
+// combineFilters joins a base filter-expression (typically the one
+// configured with -filter) with a per-host override into a single
+// expression that consul's catalog endpoint will AND together. Either
+// side may be empty. A malformed override (unbalanced parens/quotes) is
+// dropped rather than spliced in: since "and" binds tighter than "or" in
+// consul's filter grammar, a stray ")" could close the wrapping group
+// early and append an unconstrained clause at the top level, neutralizing
+// base instead of narrowing it.
+func combineFilters(base, override string) string {
+	base = strings.TrimSpace(base)
+	override = strings.TrimSpace(override)
+
+	if override != "" && !validFilterExpr(override) {
+		log.WithField("filter", override).Warn("consul-router: rejected malformed X-Consul-Filter override")
+		override = ""
+	}
+
+	switch {
+	case base == "":
+		return override
+	case override == "":
+		return base
+	default:
+		return "(" + base + ") and (" + override + ")"
+	}
+}
+
+// validFilterExpr reports whether expr has balanced parentheses and
+// quotes, so wrapping it in its own "(...)" group can't be broken out of
+// by the content it wraps.
+func validFilterExpr(expr string) bool {
+	depth := 0
+	inQuote := false
+	for _, r := range expr {
+		switch r {
+		case '"':
+			inQuote = !inQuote
+		case '(':
+			if !inQuote {
+				depth++
+			}
+		case ')':
+			if !inQuote {
+				depth--
+				if depth < 0 {
+					return false
+				}
+			}
+		}
+	}
+	return depth == 0 && !inQuote
+}
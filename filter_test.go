@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestCombineFilters(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     string
+		override string
+		want     string
+	}{
+		{"both empty", "", "", ""},
+		{"base only", `ServiceTags contains "canary"`, "", `ServiceTags contains "canary"`},
+		{"override only", "", `ServiceTags contains "canary"`, `ServiceTags contains "canary"`},
+		{
+			"both set",
+			`ServiceTags contains "canary"`,
+			`ServiceTags contains "us-east"`,
+			`(ServiceTags contains "canary") and (ServiceTags contains "us-east")`,
+		},
+		{"trims whitespace", "  base  ", "  override  ", "(base) and (override)"},
+		{
+			"malformed override is dropped, not spliced in",
+			`ServiceTags contains "prod"`,
+			`ServiceTags contains "x") or (1 == 1`,
+			`ServiceTags contains "prod"`,
+		},
+		{
+			"unbalanced quote in override is dropped",
+			`ServiceTags contains "prod"`,
+			`ServiceTags contains "x`,
+			`ServiceTags contains "prod"`,
+		},
+		{
+			"balanced parens in override are kept",
+			"base",
+			`(ServiceTags contains "canary")`,
+			`(base) and ((ServiceTags contains "canary"))`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := combineFilters(tt.base, tt.override); got != tt.want {
+				t.Errorf("combineFilters(%q, %q) = %q, want %q", tt.base, tt.override, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// h2Config carries the HTTP/2 tuning knobs shared by the downstream h2c
+// server and the upstream per-service h2c transport.
+type h2Config struct {
+	maxConcurrentStreams uint32
+	maxReadFrameSize     uint32
+	readIdleTimeout      time.Duration
+	pingTimeout          time.Duration
+}
+
+// h2cHandler wraps handler so that clients speaking HTTP/2 with prior
+// knowledge (h2c, cleartext) can reach the router without TLS, while
+// regular HTTP/1.1 clients continue to be served unchanged.
+func h2cHandler(handler http.Handler, cfg h2Config) http.Handler {
+	return h2c.NewHandler(handler, &http2.Server{
+		MaxConcurrentStreams: cfg.maxConcurrentStreams,
+		MaxReadFrameSize:     cfg.maxReadFrameSize,
+		IdleTimeout:          cfg.readIdleTimeout,
+	})
+}
+
+// newH2CTransport builds a RoundTripper that speaks HTTP/2 with prior
+// knowledge over plain TCP, used for upstream instances tagged with
+// protocol=h2c so long-lived connections through the router still get
+// dead-connection detection via ReadIdleTimeout/PingTimeout.
+func newH2CTransport(dialTimeout time.Duration, cfg h2Config) http.RoundTripper {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			dialer := &net.Dialer{Timeout: dialTimeout}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		ReadIdleTimeout:  cfg.readIdleTimeout,
+		PingTimeout:      cfg.pingTimeout,
+		MaxReadFrameSize: cfg.maxReadFrameSize,
+	}
+}
+
+// instanceProtocol returns the protocol tag value for an instance (e.g.
+// "h2c" from a "protocol=h2c" service tag), or "" if it has none.
+func instanceProtocol(instance consulInstance) string {
+	const prefix = "protocol="
+	for _, tag := range instance.Tags {
+		if strings.HasPrefix(tag, prefix) {
+			return strings.TrimPrefix(tag, prefix)
+		}
+	}
+	return ""
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
-	"io"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/net/http2"
 
 	"github.com/apex/log"
 	"github.com/apex/log/handlers/text"
@@ -41,13 +42,15 @@ func init() {
 
 func main() {
 	var config struct {
-		http    string
-		consul  string
-		datadog string
-		domain  string
-		prefer  string
-		health  string
-		pprof   string
+		http     string
+		consul   string
+		datadog  string
+		domain   string
+		prefer   string
+		filter   string
+		balancer string
+		health   string
+		pprof    string
 
 		cacheTimeout    time.Duration
 		dialTimeout     time.Duration
@@ -55,11 +58,25 @@ func main() {
 		writeTimeout    time.Duration
 		idleTimeout     time.Duration
 		shutdownTimeout time.Duration
+		drainDelay      time.Duration
 
 		maxIdleConns        int
 		maxIdleConnsPerHost int
 		maxHeaderBytes      int
 		enableCompression   bool
+
+		retryBudget      int
+		breakerThreshold float64
+		breakerCooldown  time.Duration
+		hedgeAfterP      float64
+
+		otlpEndpoint string
+		traceSampler string
+
+		h2MaxConcurrentStreams uint
+		h2MaxReadFrameSize     uint
+		h2ReadIdleTimeout      time.Duration
+		h2PingTimeout          time.Duration
 	}
 
 	flag.StringVar(&config.http, "bind-http", ":4000", "The network address on which the router will listen for incoming connections")
@@ -69,16 +86,29 @@ func main() {
 	flag.StringVar(&config.datadog, "datadog", "localhost:8125", "The address at which the router will send datadog metrics")
 	flag.StringVar(&config.domain, "domain", "localhost", "The domain for which the router will accept requests")
 	flag.StringVar(&config.prefer, "prefer", "", "The services with a tag matching the preferred value will be favored by the router")
+	flag.StringVar(&config.filter, "filter", "", "A consul catalog filter expression constraining which service instances are eligible, which can be narrowed per-request via the X-Consul-Filter header")
+	flag.StringVar(&config.balancer, "balancer", "random", "The load balancing strategy used to pick among service instances: random, weighted-round-robin, or p2c-ewma")
 	flag.DurationVar(&config.cacheTimeout, "cache-timeout", 10*time.Second, "The timeout for cached hostnames")
 	flag.DurationVar(&config.dialTimeout, "dial-timeout", 10*time.Second, "The timeout for dialing tcp connections")
 	flag.DurationVar(&config.readTimeout, "read-timeout", 30*time.Second, "The timeout for reading http requests")
 	flag.DurationVar(&config.writeTimeout, "write-timeout", 30*time.Second, "The timeout for writing http requests")
 	flag.DurationVar(&config.idleTimeout, "idle-timeout", 90*time.Second, "The timeout for idle connections")
 	flag.DurationVar(&config.shutdownTimeout, "shutdown-timeout", 10*time.Second, "The timeout for shutting down the router")
+	flag.DurationVar(&config.drainDelay, "drain-delay", 0, "How long to wait after flipping the health check to 503 before starting shutdown, giving load balancers time to stop sending new traffic")
 	flag.IntVar(&config.maxIdleConns, "max-idle-conns", 10000, "The maximum number of idle connections kept")
 	flag.IntVar(&config.maxIdleConnsPerHost, "max-idle-conns-per-host", 100, "The maximum number of idle connections kept per host")
 	flag.IntVar(&config.maxHeaderBytes, "max-header-bytes", 65536, "The maximum number of bytes allowed in http headers")
 	flag.BoolVar(&config.enableCompression, "enable-compression", false, "When set the router will ask for compressed payloads")
+	flag.IntVar(&config.retryBudget, "retry-budget", 0, "The number of times an idempotent request may be retried against the upstream transport")
+	flag.Float64Var(&config.breakerThreshold, "breaker-threshold", 0, "The rolling error rate, between 0 and 1, at which a backend's circuit breaker opens; 0 disables circuit breaking")
+	flag.DurationVar(&config.breakerCooldown, "breaker-cooldown", 30*time.Second, "How long a backend's circuit stays open before a probe request is allowed through to check if it has recovered")
+	flag.Float64Var(&config.hedgeAfterP, "hedge-after-p", 0, "Fire a hedged request to a different instance once the primary attempt has run this many times the backend's estimated latency; 0 disables hedging")
+	flag.StringVar(&config.otlpEndpoint, "otlp-endpoint", "", "The OTLP/HTTP endpoint to which router spans are exported; when unset tracing is disabled")
+	flag.StringVar(&config.traceSampler, "trace-sampler", "always", "The trace sampler: always, never, or parentbased-traceidratio=<p>")
+	flag.UintVar(&config.h2MaxConcurrentStreams, "h2-max-concurrent-streams", 250, "The maximum number of concurrent HTTP/2 streams per connection")
+	flag.UintVar(&config.h2MaxReadFrameSize, "h2-max-read-frame-size", 1<<20, "The maximum HTTP/2 frame size the router is willing to read")
+	flag.DurationVar(&config.h2ReadIdleTimeout, "h2-read-idle-timeout", 30*time.Second, "How long an upstream protocol=h2c connection may be idle before the router pings it to check it's still alive; downstream HTTP/2 connections idle this long are closed instead")
+	flag.DurationVar(&config.h2PingTimeout, "h2-ping-timeout", 15*time.Second, "How long the router waits for a ping response before closing an upstream protocol=h2c connection")
 	flag.Parse()
 
 	// Atomic variable set to the http status returned by the http health check.
@@ -90,11 +120,32 @@ func main() {
 	})
 	defer dd.Close()
 
-	// The consul-based resolver used to lookup services.
+	// Tracing: extracts/injects W3C traceparent and exports spans via OTLP.
+	shutdownTracing, err := setupTracing(config.otlpEndpoint, config.traceSampler)
+	if err != nil {
+		log.WithError(err).Fatal("failed to configure tracing")
+	}
+	defer shutdownTracing(context.Background())
+
+	// The consul-based resolver used to lookup services. It gets its own
+	// transport rather than http.DefaultTransport, since the latter is
+	// wrapped below with a circuit breaker meant for proxied backends, not
+	// consul's catalog endpoint.
 	rslv := consulResolver{
 		address: config.consul,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:         dialer(config.dialTimeout),
+				IdleConnTimeout:     config.idleTimeout,
+				MaxIdleConnsPerHost: config.maxIdleConnsPerHost,
+			},
+			Timeout: config.readTimeout,
+		},
 	}
 
+	// The balancer used to pick among the instances returned by the resolver.
+	bal := newBalancer(config.balancer)
+
 	// The domain name served by the router, prefix with '.' so it doesn't have
 	// to be done over and over in each http request.
 	domain := config.domain
@@ -104,9 +155,14 @@ func main() {
 
 	// Start the health check server.
 	if len(config.health) != 0 {
-		go http.ListenAndServe(config.health, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
 			res.WriteHeader(int(atomic.LoadUint32(&healthStatus)))
-		}))
+		})
+		mux.HandleFunc("/balancer", func(res http.ResponseWriter, req *http.Request) {
+			json.NewEncoder(res).Encode(bal.scores())
+		})
+		go http.ListenAndServe(config.health, mux)
 	}
 
 	// Start hte profiler server.
@@ -114,8 +170,15 @@ func main() {
 		go http.ListenAndServe(config.pprof, nil)
 	}
 
+	h2Cfg := h2Config{
+		maxConcurrentStreams: uint32(config.h2MaxConcurrentStreams),
+		maxReadFrameSize:     uint32(config.h2MaxReadFrameSize),
+		readIdleTimeout:      config.h2ReadIdleTimeout,
+		pingTimeout:          config.h2PingTimeout,
+	}
+
 	// Configure the default http transport which is used for forwarding the requests.
-	http.DefaultTransport = httpstats.NewTransport(nil, &http.Transport{
+	httpTransport := &http.Transport{
 		DialContext:            dialer(config.dialTimeout),
 		IdleConnTimeout:        config.idleTimeout,
 		MaxIdleConns:           config.maxIdleConns,
@@ -124,7 +187,22 @@ func main() {
 		ExpectContinueTimeout:  config.readTimeout,
 		MaxResponseHeaderBytes: int64(config.maxHeaderBytes),
 		DisableCompression:     !config.enableCompression,
-	})
+	}
+	if err := http2.ConfigureTransport(httpTransport); err != nil {
+		log.WithError(err).Fatal("failed to configure http/2 upstream transport")
+	}
+
+	// Layer on resilience: a circuit breaker per backend, and retries with
+	// backoff for idempotent requests that still have retry budget left.
+	var transport http.RoundTripper = httpstats.NewTransport(nil, httpTransport)
+	transport = wrapResilience(transport, config.breakerThreshold, config.breakerCooldown, config.retryBudget)
+	http.DefaultTransport = transport
+
+	// A dedicated transport for upstream instances tagged protocol=h2c,
+	// since prior-knowledge h2c can't be negotiated through http.Transport.
+	// Wrapped with the same resilience treatment as the primary transport
+	// so h2c-tagged backends aren't silently exempt from it.
+	h2cTransport := wrapResilience(newH2CTransport(config.dialTimeout, h2Cfg), config.breakerThreshold, config.breakerCooldown, config.retryBudget)
 
 	// Configure and run the http server.
 	httpLstn, err := net.Listen("tcp", config.http)
@@ -135,32 +213,41 @@ func main() {
 		}).Fatal("failed to bind tcp address for http server")
 	}
 
-	httpStop := make(chan struct{})
-	httpDone := make(chan struct{})
+	srv := newServer(serverConfig{
+		rslv:         rslv,
+		domain:       domain,
+		prefer:       config.prefer,
+		filter:       config.filter,
+		bal:          bal,
+		h2cTransport: h2cTransport,
+		hedgeAfterP:  config.hedgeAfterP,
+		cacheTimeout: config.cacheTimeout,
+	})
+
+	httpSrv := &http.Server{
+		ReadTimeout:    config.readTimeout,
+		WriteTimeout:   config.writeTimeout,
+		MaxHeaderBytes: config.maxHeaderBytes,
+		Handler:        h2cHandler(httpstats.NewHandler(nil, srv), h2Cfg),
+	}
+	httpSrv.RegisterOnShutdown(func() {
+		log.Info("shutdown: waiting for hijacked connections to drain")
+	})
+
 	go func() {
-		switch err := (&http.Server{
-			ReadTimeout:    config.readTimeout,
-			WriteTimeout:   config.writeTimeout,
-			MaxHeaderBytes: config.maxHeaderBytes,
-			Handler: httpstats.NewHandler(nil, newServer(serverConfig{
-				stop:         httpStop,
-				done:         httpDone,
-				rslv:         rslv,
-				domain:       domain,
-				prefer:       config.prefer,
-				cacheTimeout: config.cacheTimeout,
-			})),
-		}).Serve(httpLstn); err {
-		case nil, io.EOF:
+		switch err := httpSrv.Serve(httpLstn); err {
+		case nil, http.ErrServerClosed:
 		default:
 			log.WithError(err).Fatal("failed to serve http requests")
 		}
 	}()
 
 	// Gracefully shutdown when receiving a signal:
-	// - set the health check status to 503
-	// - close tcp connections
-	// - wait for in-flight requests to complete
+	// - flip the health check to 503 and wait drain-delay for load
+	//   balancers to notice and stop sending new traffic
+	// - call http.Server.Shutdown to stop accepting connections, close
+	//   idle keep-alives, and let in-flight requests drain naturally
+	// - wait for any hijacked/websocket connections to finish draining
 	sigchan := make(chan os.Signal)
 	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
 
@@ -168,19 +255,15 @@ func main() {
 	log.WithField("signal", sig).Info("shutting down")
 
 	atomic.StoreUint32(&healthStatus, http.StatusServiceUnavailable)
-	httpLstn.Close()
-	close(httpStop)
-
-	for httpDone != nil {
-		select {
-		case <-time.After(config.shutdownTimeout):
-			return
-		case <-sigchan:
-			return
-		case <-httpDone:
-			httpDone = nil
-		}
+	time.Sleep(config.drainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.shutdownTimeout)
+	defer cancel()
+
+	if err := httpSrv.Shutdown(ctx); err != nil {
+		log.WithError(err).Warn("timed out waiting for connections to drain")
 	}
+	srv.waitForHijacked(ctx)
 }
 
 func dialer(timeout time.Duration) func(context.Context, string, string) (net.Conn, error) {
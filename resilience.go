@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// retryCountHeader carries the number of retry attempts spent on a
+// request back to the caller, so the tracing layer can record it as a
+// span attribute without threading extra state through the transport
+// chain. The router strips it before the response reaches the client.
+const retryCountHeader = "X-Consul-Router-Retry-Count"
+
+// errCircuitOpen is returned by breakerTransport when a backend's circuit
+// is open and the request is rejected without being attempted.
+var errCircuitOpen = errors.New("consul-router: circuit breaker open")
+
+// circuitState enumerates the states of a per-backend circuit breaker.
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitWindowSize is the number of most recent outcomes a circuit
+// breaker considers when computing its rolling error rate.
+const circuitWindowSize = 20
+
+// circuitBreaker implements a rolling error-rate breaker for a single
+// backend: closed lets requests through while tracking a window of
+// outcomes, open rejects requests until cooldown elapses, half-open lets a
+// single probe through to decide whether to close or re-open.
+type circuitBreaker struct {
+	threshold float64
+	cooldown  time.Duration
+
+	mutex    sync.Mutex
+	state    circuitState
+	openedAt time.Time
+	window   []bool
+}
+
+func newCircuitBreaker(threshold float64, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+func (c *circuitBreaker) allow() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	switch c.state {
+	case circuitClosed:
+		return true
+	case circuitHalfOpen:
+		// A probe is already in flight; reject everything else until it
+		// resolves the state one way or the other.
+		return false
+	default: // circuitOpen
+		if time.Since(c.openedAt) < c.cooldown {
+			return false
+		}
+		c.state = circuitHalfOpen
+		return true
+	}
+}
+
+func (c *circuitBreaker) report(success bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.state == circuitHalfOpen {
+		if success {
+			c.state = circuitClosed
+			c.window = nil
+		} else {
+			c.state = circuitOpen
+			c.openedAt = time.Now()
+		}
+		return
+	}
+
+	c.window = append(c.window, success)
+	if len(c.window) > circuitWindowSize {
+		c.window = c.window[len(c.window)-circuitWindowSize:]
+	}
+	if len(c.window) < circuitWindowSize {
+		return
+	}
+
+	failures := 0
+	for _, ok := range c.window {
+		if !ok {
+			failures++
+		}
+	}
+	if float64(failures)/float64(len(c.window)) >= c.threshold {
+		c.state = circuitOpen
+		c.openedAt = time.Now()
+	}
+}
+
+// breakerTransport wraps a RoundTripper with a circuit breaker per
+// backend host, so a failing instance stops receiving traffic until it
+// has had time to recover.
+type breakerTransport struct {
+	next      http.RoundTripper
+	threshold float64
+	cooldown  time.Duration
+
+	mutex    sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func newBreakerTransport(next http.RoundTripper, threshold float64, cooldown time.Duration) *breakerTransport {
+	return &breakerTransport{
+		next:      next,
+		threshold: threshold,
+		cooldown:  cooldown,
+		breakers:  make(map[string]*circuitBreaker),
+	}
+}
+
+func (t *breakerTransport) breaker(host string) *circuitBreaker {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	b, ok := t.breakers[host]
+	if !ok {
+		b = newCircuitBreaker(t.threshold, t.cooldown)
+		t.breakers[host] = b
+	}
+	return b
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b := t.breaker(req.URL.Host)
+	if !b.allow() {
+		return nil, errCircuitOpen
+	}
+
+	res, err := t.next.RoundTrip(req)
+	b.report(err == nil && res.StatusCode < http.StatusInternalServerError)
+	return res, err
+}
+
+// idempotentMethods are the http methods safe to retry without risking a
+// duplicated side effect.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// retryTransport retries idempotent requests with exponential backoff and
+// jitter, bounded by a per-request retry budget.
+type retryTransport struct {
+	next   http.RoundTripper
+	budget int
+
+	base time.Duration
+	max  time.Duration
+}
+
+func newRetryTransport(next http.RoundTripper, budget int) *retryTransport {
+	return &retryTransport{next: next, budget: budget, base: 50 * time.Millisecond, max: 2 * time.Second}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.budget <= 0 || !idempotentMethods[req.Method] {
+		return t.next.RoundTrip(req)
+	}
+
+	// Inbound requests (and httputil.ReverseProxy's clones of them) never
+	// populate GetBody, so without this the first attempt would drain
+	// req.Body and every retry after it would replay an empty body. Buffer
+	// the body once up front so every attempt gets its own reader.
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		buf, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(buf))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(buf)), nil
+		}
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= t.budget; attempt++ {
+		if attempt > 0 {
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				req.Body = body
+			}
+			time.Sleep(retryBackoff(attempt, t.base, t.max))
+		}
+
+		res, err := t.next.RoundTrip(req)
+		if err == nil && res.StatusCode < http.StatusInternalServerError {
+			res.Header.Set(retryCountHeader, strconv.Itoa(attempt))
+			return res, nil
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+		lastErr = err
+		if lastErr == nil {
+			lastErr = errors.New("consul-router: upstream returned " + res.Status)
+		}
+	}
+
+	return nil, lastErr
+}
+
+// retryBackoff computes an exponential backoff with full jitter for the
+// given attempt number (1-indexed).
+func retryBackoff(attempt int, base, max time.Duration) time.Duration {
+	d := base * time.Duration(uint(1)<<uint(attempt-1))
+	if d > max || d <= 0 {
+		d = max
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// wrapResilience layers a per-backend circuit breaker and bounded,
+// backed-off retries onto next. It's used for every transport that can
+// reach a proxied backend — including the router's per-service h2c
+// transport — so that which transport an instance happens to use doesn't
+// change whether it gets this behavior.
+func wrapResilience(next http.RoundTripper, breakerThreshold float64, breakerCooldown time.Duration, retryBudget int) http.RoundTripper {
+	if breakerThreshold > 0 {
+		next = newBreakerTransport(next, breakerThreshold, breakerCooldown)
+	}
+	if retryBudget > 0 {
+		next = newRetryTransport(next, retryBudget)
+	}
+	return next
+}
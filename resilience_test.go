@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	cb := newCircuitBreaker(0.5, time.Minute)
+
+	// Fill the window with successes; the breaker should stay closed.
+	for i := 0; i < circuitWindowSize; i++ {
+		if !cb.allow() {
+			t.Fatalf("allow() = false while closed")
+		}
+		cb.report(true)
+	}
+	if cb.state != circuitClosed {
+		t.Fatalf("state = %v, want circuitClosed", cb.state)
+	}
+
+	// Replace the window with enough failures to cross the 0.5 threshold.
+	for i := 0; i < circuitWindowSize; i++ {
+		cb.report(false)
+	}
+	if cb.state != circuitOpen {
+		t.Fatalf("state = %v, want circuitOpen", cb.state)
+	}
+	if cb.allow() {
+		t.Errorf("allow() = true immediately after opening, want false")
+	}
+}
+
+func TestCircuitBreakerHalfOpenAdmitsOnlyOneProbe(t *testing.T) {
+	cb := newCircuitBreaker(0.5, 0) // zero cooldown: always eligible to probe once open
+	cb.state = circuitOpen
+	cb.openedAt = time.Now().Add(-time.Second)
+
+	if !cb.allow() {
+		t.Fatalf("allow() = false for the first call after cooldown, want true (the probe)")
+	}
+	if cb.state != circuitHalfOpen {
+		t.Fatalf("state = %v, want circuitHalfOpen", cb.state)
+	}
+
+	// Concurrent callers arriving while the probe is in flight must all be
+	// rejected, not just let through alongside it.
+	for i := 0; i < 5; i++ {
+		if cb.allow() {
+			t.Errorf("allow() = true for call %d while a probe is in flight, want false", i)
+		}
+	}
+}
+
+func TestCircuitBreakerHalfOpenResolvesOnReport(t *testing.T) {
+	cb := newCircuitBreaker(0.5, 0)
+	cb.state = circuitHalfOpen
+
+	cb.report(true)
+	if cb.state != circuitClosed {
+		t.Errorf("state after successful probe = %v, want circuitClosed", cb.state)
+	}
+
+	cb.state = circuitHalfOpen
+	cb.report(false)
+	if cb.state != circuitOpen {
+		t.Errorf("state after failed probe = %v, want circuitOpen", cb.state)
+	}
+}
+
+func TestRetryBackoffWithinBounds(t *testing.T) {
+	base := 50 * time.Millisecond
+	max := 2 * time.Second
+
+	for attempt := 1; attempt <= 10; attempt++ {
+		for i := 0; i < 20; i++ {
+			d := retryBackoff(attempt, base, max)
+			if d < 0 || d > max {
+				t.Fatalf("retryBackoff(%d) = %v, want within [0, %v]", attempt, d, max)
+			}
+		}
+	}
+}
+
+func TestRetryBackoffCapsAtMax(t *testing.T) {
+	base := 50 * time.Millisecond
+	max := 200 * time.Millisecond
+
+	// A large attempt number pushes the exponential term far past max; the
+	// result must still be capped at max.
+	for i := 0; i < 20; i++ {
+		d := retryBackoff(30, base, max)
+		if d < 0 || d > max {
+			t.Fatalf("retryBackoff(30) = %v, want within [0, %v]", d, max)
+		}
+	}
+}
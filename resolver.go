@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// consulInstance is a single service instance as returned by consul's
+// catalog API.
+type consulInstance struct {
+	ID      string            `json:"ServiceID"`
+	Address string            `json:"ServiceAddress"`
+	Node    string            `json:"Node"`
+	Port    int               `json:"ServicePort"`
+	Tags    []string          `json:"ServiceTags"`
+	Meta    map[string]string `json:"ServiceMeta"`
+	Weights struct {
+		Passing int `json:"Passing"`
+		Warning int `json:"Warning"`
+	} `json:"ServiceWeights"`
+}
+
+// consulResolver looks up service instances from a consul agent's catalog
+// endpoint.
+type consulResolver struct {
+	address string
+
+	// client performs the catalog lookups. It must be its own client,
+	// independent of http.DefaultTransport: main.go wraps that transport
+	// with a per-backend circuit breaker for proxied traffic, and keying
+	// that breaker on consul's own address would let a transient consul
+	// blip trip a breaker that then rejects service discovery router-wide
+	// for a full cooldown period after consul has already recovered.
+	client *http.Client
+}
+
+// lookup queries consul's /v1/catalog/service/<name> endpoint for the
+// instances of the named service, optionally constraining the result set
+// with a filter expression (consul's filter-expression syntax, e.g.
+// `ServiceTags contains "canary"`).
+func (r consulResolver) lookup(name string, filter string) ([]consulInstance, error) {
+	u := url.URL{
+		Scheme: "http",
+		Host:   r.address,
+		Path:   "/v1/catalog/service/" + name,
+	}
+
+	if filter != "" {
+		q := u.Query()
+		q.Set("filter", filter)
+		u.RawQuery = q.Encode()
+	}
+
+	res, err := r.client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul: %s: %s", u.String(), res.Status)
+	}
+
+	var instances []consulInstance
+	if err := json.NewDecoder(res.Body).Decode(&instances); err != nil {
+		return nil, err
+	}
+
+	return instances, nil
+}
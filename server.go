@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// serverConfig carries the configuration needed to construct the router's
+// http.Handler.
+type serverConfig struct {
+	rslv consulResolver
+
+	domain string
+	prefer string
+	filter string
+
+	bal balancer
+
+	// h2cTransport, when set, is used instead of http.DefaultTransport for
+	// instances tagged protocol=h2c.
+	h2cTransport http.RoundTripper
+
+	// hedgeAfterP, when greater than zero, enables hedged requests: a
+	// second attempt against a different instance is fired once the
+	// primary attempt has been outstanding longer than hedgeAfterP times
+	// the balancer's latency estimate for it (used as a P95 proxy).
+	hedgeAfterP float64
+
+	cacheTimeout time.Duration
+}
+
+// cacheEntry holds the result of resolving a service name, including the
+// filter expression that produced it so a later lookup with a different
+// per-host override doesn't serve a stale, differently-filtered result.
+type cacheEntry struct {
+	instances []consulInstance
+	filter    string
+	expiresAt time.Time
+}
+
+// server implements http.Handler, routing requests to consul services
+// resolved from the Host header.
+//
+// http.Server.Shutdown already waits for in-flight requests to complete,
+// but it has no visibility into connections a handler has hijacked out
+// from under it (websocket upgrades proxied by httputil.ReverseProxy), so
+// the server tracks those itself via hijacked.
+type server struct {
+	serverConfig
+
+	mutex sync.Mutex
+	cache map[string]cacheEntry
+
+	hijacked int64
+}
+
+// newServer constructs the router's http.Handler.
+func newServer(config serverConfig) *server {
+	return &server{
+		serverConfig: config,
+		cache:        make(map[string]cacheEntry),
+	}
+}
+
+// waitForHijacked blocks until every hijacked connection has closed or ctx
+// is done, whichever comes first.
+func (s *server) waitForHijacked(ctx context.Context) {
+	for atomic.LoadInt64(&s.hijacked) != 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w = &hijackTrackingWriter{ResponseWriter: w, hijacked: &s.hijacked}
+
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "router.proxy")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	name := s.serviceName(r.Host)
+	span.SetAttributes(attribute.String("consul.service", name))
+	if name == "" {
+		http.Error(w, "could not determine service name from host: "+r.Host, http.StatusBadGateway)
+		return
+	}
+
+	filter := combineFilters(s.filter, r.Header.Get(filterHeader))
+
+	instances, hit, err := s.resolve(name, filter)
+	span.SetAttributes(attribute.Bool("consul.cache_hit", hit))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"service": name,
+			"error":   err,
+		}).Error("failed to resolve service")
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if len(instances) == 0 {
+		http.Error(w, "no instances found for service: "+name, http.StatusBadGateway)
+		return
+	}
+
+	bal := s.bal
+	if bal == nil {
+		bal = randomBalancer{}
+	}
+	candidates := filterPreferred(instances, s.prefer)
+	instance := bal.pick(candidates)
+	addr := instanceAddr(instance)
+
+	preferMatch := false
+	if s.prefer != "" {
+		for _, tag := range instance.Tags {
+			if tag == s.prefer {
+				preferMatch = true
+				break
+			}
+		}
+	}
+
+	span.SetAttributes(
+		attribute.String("consul.instance", addr),
+		attribute.Bool("consul.prefer_match", preferMatch),
+	)
+
+	if secondary, delay, ok := s.hedgeTarget(bal, candidates, addr, r.Method); ok {
+		s.serveHedged(w, r, bal, delay, instance, secondary)
+		return
+	}
+
+	proxy := httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = addr
+		},
+		Transport: &balancerTransport{next: s.transportFor(instance), bal: bal, addr: addr},
+		ModifyResponse: func(res *http.Response) error {
+			if retries := res.Header.Get(retryCountHeader); retries != "" {
+				span.SetAttributes(attribute.String("consul.retry_count", retries))
+				res.Header.Del(retryCountHeader)
+			}
+			return nil
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// hedgeableMethods are the methods safe to hedge: bodyless requests, so
+// firing a second attempt never means two goroutines reading the same
+// request body concurrently.
+var hedgeableMethods = map[string]bool{
+	http.MethodGet:  true,
+	http.MethodHead: true,
+}
+
+// hedgeTarget returns a second instance to race the primary against, and
+// the delay to wait before firing it, when hedging is enabled and safe for
+// this request.
+func (s *server) hedgeTarget(bal balancer, candidates []consulInstance, primary, method string) (instance consulInstance, delay time.Duration, ok bool) {
+	if s.hedgeAfterP <= 0 || len(candidates) < 2 || !hedgeableMethods[method] {
+		return consulInstance{}, 0, false
+	}
+
+	estimate := bal.estimate(primary)
+	if estimate <= 0 {
+		return consulInstance{}, 0, false
+	}
+
+	for _, candidate := range candidates {
+		if instanceAddr(candidate) != primary {
+			return candidate, time.Duration(float64(estimate) * s.hedgeAfterP), true
+		}
+	}
+	return consulInstance{}, 0, false
+}
+
+// transportFor returns the RoundTripper used to reach instance: the
+// resilience-wrapped http.DefaultTransport, or the router's dedicated h2c
+// transport for instances tagged protocol=h2c. Both the direct proxy path
+// and hedged requests call this so an instance's transport never depends
+// on which path picked it.
+func (s *server) transportFor(instance consulInstance) http.RoundTripper {
+	if instanceProtocol(instance) == "h2c" && s.h2cTransport != nil {
+		return s.h2cTransport
+	}
+	return http.DefaultTransport
+}
+
+// serveHedged races the primary instance against a second instance fired
+// after delay has elapsed without a response, returning whichever response
+// arrives first and cancelling the loser via its own context.
+func (s *server) serveHedged(w http.ResponseWriter, r *http.Request, bal balancer, delay time.Duration, primary, secondary consulInstance) {
+	type attempt struct {
+		res     *http.Response
+		err     error
+		primary bool
+	}
+
+	// Each attempt gets its own context derived from the request's, rather
+	// than sharing one: cancelling a shared context as soon as the first
+	// result arrives would also cancel the winner's context, breaking its
+	// still-unread response body with "context canceled".
+	primaryCtx, primaryCancel := context.WithCancel(r.Context())
+	defer primaryCancel()
+	secondaryCtx, secondaryCancel := context.WithCancel(r.Context())
+	defer secondaryCancel()
+
+	results := make(chan attempt, 2)
+	fire := func(instance consulInstance, ctx context.Context, isPrimary bool) {
+		addr := instanceAddr(instance)
+
+		req := r.Clone(ctx)
+		req.URL.Scheme = "http"
+		req.URL.Host = addr
+		req.RequestURI = ""
+
+		transport := &balancerTransport{next: s.transportFor(instance), bal: bal, addr: addr}
+		res, err := transport.RoundTrip(req)
+		results <- attempt{res: res, err: err, primary: isPrimary}
+	}
+
+	go fire(primary, primaryCtx, true)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	fired := 1
+	var winner attempt
+	select {
+	case winner = <-results:
+	case <-timer.C:
+		go fire(secondary, secondaryCtx, false)
+		fired = 2
+		winner = <-results
+	}
+
+	// Cancel only the loser's context now. The winner's is left alone
+	// until this handler returns (via the defers above), by which point
+	// its body has already been copied to the client.
+	if fired == 2 {
+		if winner.primary {
+			secondaryCancel()
+		} else {
+			primaryCancel()
+		}
+		go func() {
+			if loser := <-results; loser.res != nil {
+				io.Copy(io.Discard, loser.res.Body)
+				loser.res.Body.Close()
+			}
+		}()
+	}
+
+	if winner.err != nil {
+		log.WithError(winner.err).Error("hedged request failed")
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer winner.res.Body.Close()
+
+	winner.res.Header.Del(retryCountHeader)
+	for key, values := range winner.res.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(winner.res.StatusCode)
+	io.Copy(w, winner.res.Body)
+}
+
+// balancerTransport wraps the router's upstream transport to report
+// in-flight counts and observed latency back to the balancer, so that
+// strategies like p2c-ewma get their feedback loop for free off the same
+// round trip the proxy was going to make anyway.
+type balancerTransport struct {
+	next http.RoundTripper
+	bal  balancer
+	addr string
+}
+
+func (t *balancerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+
+	t.bal.reportStart(t.addr)
+	defer t.bal.reportDone(t.addr)
+
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	if err == nil {
+		t.bal.reportLatency(t.addr, time.Since(start))
+	}
+	return res, err
+}
+
+// serviceName extracts the consul service name from the request host by
+// stripping the configured domain suffix.
+func (s *server) serviceName(host string) string {
+	if i := strings.IndexByte(host, ':'); i >= 0 {
+		host = host[:i]
+	}
+	if !strings.HasSuffix(host, s.domain) {
+		return ""
+	}
+	return strings.TrimSuffix(host, s.domain)
+}
+
+// resolve returns the cached instances for name+filter, refreshing the
+// cache from consul when the entry is missing or has expired. The second
+// return value reports whether the cache was hit.
+func (s *server) resolve(name, filter string) ([]consulInstance, bool, error) {
+	key := name + "\x00" + filter
+
+	s.mutex.Lock()
+	entry, ok := s.cache[key]
+	s.mutex.Unlock()
+
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.instances, true, nil
+	}
+
+	instances, err := s.rslv.lookup(name, filter)
+	if err != nil {
+		return nil, false, err
+	}
+
+	s.mutex.Lock()
+	s.cache[key] = cacheEntry{
+		instances: instances,
+		filter:    filter,
+		expiresAt: time.Now().Add(s.cacheTimeout),
+	}
+	s.mutex.Unlock()
+
+	return instances, false, nil
+}
+
+// filterPreferred narrows instances down to the ones tagged with prefer,
+// when any are present; otherwise it returns instances unchanged.
+func filterPreferred(instances []consulInstance, prefer string) []consulInstance {
+	if prefer == "" {
+		return instances
+	}
+
+	var preferred []consulInstance
+	for _, instance := range instances {
+		for _, tag := range instance.Tags {
+			if tag == prefer {
+				preferred = append(preferred, instance)
+				break
+			}
+		}
+	}
+	if len(preferred) == 0 {
+		return instances
+	}
+	return preferred
+}
+
+// hijackTrackingWriter wraps a ResponseWriter so that a connection
+// hijacked off of it (e.g. to proxy a websocket upgrade) is counted until
+// it closes, letting the server's shutdown path drain it explicitly since
+// http.Server.Shutdown has no visibility into hijacked connections.
+type hijackTrackingWriter struct {
+	http.ResponseWriter
+	hijacked *int64
+}
+
+func (w *hijackTrackingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("consul-router: response writer does not support hijacking")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, rw, err
+	}
+
+	atomic.AddInt64(w.hijacked, 1)
+	return &hijackedConn{Conn: conn, hijacked: w.hijacked}, rw, nil
+}
+
+// hijackedConn decrements its server's hijacked counter the first time
+// it's closed.
+type hijackedConn struct {
+	net.Conn
+	hijacked *int64
+	once     sync.Once
+}
+
+func (c *hijackedConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(c.hijacked, -1) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the router as the instrumentation source for the
+// spans it creates.
+const tracerName = "github.com/segmentio/consul-router"
+
+// setupTracing installs a global TracerProvider exporting via OTLP/HTTP to
+// otlpEndpoint, sampling according to sampler ("always", "never", or
+// "parentbased-traceidratio=<p>"). When otlpEndpoint is empty, tracing is a
+// no-op. The returned func flushes and shuts the provider down.
+func setupTracing(otlpEndpoint, sampler string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if otlpEndpoint == "" {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		return func(context.Context) error { return nil }, nil
+	}
+
+	samp, err := parseSampler(sampler)
+	if err != nil {
+		return nil, err
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpoint(otlpEndpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceNameKey.String("consul-router")))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(samp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// parseSampler parses the -trace-sampler flag value into an sdk sampler.
+func parseSampler(name string) (sdktrace.Sampler, error) {
+	switch {
+	case name == "" || name == "always":
+		return sdktrace.AlwaysSample(), nil
+	case name == "never":
+		return sdktrace.NeverSample(), nil
+	case strings.HasPrefix(name, "parentbased-traceidratio="):
+		ratio, err := strconv.ParseFloat(strings.TrimPrefix(name, "parentbased-traceidratio="), 64)
+		if err != nil {
+			return nil, fmt.Errorf("consul-router: invalid -trace-sampler %q: %w", name, err)
+		}
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio)), nil
+	default:
+		return nil, fmt.Errorf("consul-router: unknown -trace-sampler %q", name)
+	}
+}